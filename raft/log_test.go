@@ -0,0 +1,154 @@
+package raft
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+// newTestRaftLog builds a RaftLog whose unstable buffer holds ents and
+// nothing else, so storage is never consulted as long as a test only
+// touches indices >= ents[0].Index.
+func newTestRaftLog(ents []pb.Entry) *RaftLog {
+	l := &RaftLog{maxNextEntsSize: noLimit}
+	l.unstable.offset = ents[0].Index
+	l.unstable.entries = append([]pb.Entry{}, ents...)
+	return l
+}
+
+// newTestRaftLogFromSnapshot builds a RaftLog via restore() at
+// baseIndex/1, then appends ents on top. Going through restore gives
+// unstable a pending snapshot, so FirstIndex() resolves via
+// unstable.maybeFirstIndex() instead of falling through to l.storage,
+// which is nil in these tests and would panic on a method call.
+func newTestRaftLogFromSnapshot(baseIndex uint64, ents ...*pb.Entry) *RaftLog {
+	l := &RaftLog{maxNextEntsSize: noLimit}
+	l.restore(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: baseIndex, Term: 1}})
+	if len(ents) > 0 {
+		l.AppendEntries(ents...)
+	}
+	return l
+}
+
+func TestMaybeAppendExactDuplicateIsNoop(t *testing.T) {
+	l := newTestRaftLog([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}})
+	l.committed = 1
+	before := append([]pb.Entry{}, l.unstable.entries...)
+
+	lastnewi, ok := l.maybeAppend(1, 1, 2, pb.Entry{Index: 2, Term: 1}, pb.Entry{Index: 3, Term: 2})
+	if !ok || lastnewi != 3 {
+		t.Fatalf("expected ok=true, lastnewi=3, got ok=%v, lastnewi=%d", ok, lastnewi)
+	}
+	if !reflect.DeepEqual(before, l.unstable.entries) {
+		t.Fatalf("exact duplicate append should not touch the log, got %v", l.unstable.entries)
+	}
+	if l.committed != 2 {
+		t.Fatalf("expected committed to advance to 2, got %d", l.committed)
+	}
+}
+
+func TestMaybeAppendMatchingPrefixAppendsOnlyNew(t *testing.T) {
+	l := newTestRaftLog([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}})
+	l.committed = 1
+
+	lastnewi, ok := l.maybeAppend(1, 1, 1,
+		pb.Entry{Index: 2, Term: 1}, pb.Entry{Index: 3, Term: 2}, pb.Entry{Index: 4, Term: 2})
+	if !ok || lastnewi != 4 {
+		t.Fatalf("expected ok=true, lastnewi=4, got ok=%v, lastnewi=%d", ok, lastnewi)
+	}
+	want := []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}, {Index: 4, Term: 2}}
+	if !reflect.DeepEqual(want, l.unstable.entries) {
+		t.Fatalf("expected the overlapping prefix to be kept and only index 4 appended, got %v", l.unstable.entries)
+	}
+}
+
+func TestMaybeAppendDivergentSuffixIsReplaced(t *testing.T) {
+	l := newTestRaftLog([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}})
+	l.committed = 1
+
+	lastnewi, ok := l.maybeAppend(1, 1, 1, pb.Entry{Index: 2, Term: 1}, pb.Entry{Index: 3, Term: 3})
+	if !ok || lastnewi != 3 {
+		t.Fatalf("expected ok=true, lastnewi=3, got ok=%v, lastnewi=%d", ok, lastnewi)
+	}
+	want := []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 3}}
+	if !reflect.DeepEqual(want, l.unstable.entries) {
+		t.Fatalf("expected the diverging suffix to be overwritten, got %v", l.unstable.entries)
+	}
+}
+
+func TestMaybeAppendCommittedClampedToLastNewIndex(t *testing.T) {
+	l := newTestRaftLog([]pb.Entry{{Index: 1, Term: 1}})
+	l.committed = 1
+
+	// the leader claims committed=5, but we only learn about index 2 here;
+	// commitTo must not run ahead of what we actually just appended.
+	lastnewi, ok := l.maybeAppend(1, 1, 5, pb.Entry{Index: 2, Term: 1})
+	if !ok || lastnewi != 2 {
+		t.Fatalf("expected ok=true, lastnewi=2, got ok=%v, lastnewi=%d", ok, lastnewi)
+	}
+	if l.committed != 2 {
+		t.Fatalf("expected committed clamped to lastnewi=2, got %d", l.committed)
+	}
+}
+
+func TestNextEntsEmptyWindow(t *testing.T) {
+	l := newTestRaftLogFromSnapshot(1)
+	l.committed = 1
+	l.applied = 1
+
+	if ents := l.nextEnts(); ents != nil {
+		t.Fatalf("expected no entries on an empty window, got %v", ents)
+	}
+	if l.hasNextEnts() {
+		t.Fatalf("hasNextEnts should be false on an empty window")
+	}
+}
+
+func TestNextEntsSingleOversizedEntryStillReturned(t *testing.T) {
+	big := pb.Entry{Index: 2, Term: 1, Data: make([]byte, 4096)}
+	l := newTestRaftLogFromSnapshot(1, &big)
+	l.committed = 2
+	l.applied = 1
+	l.maxNextEntsSize = 1 // far smaller than the single entry
+
+	ents := l.nextEnts()
+	if len(ents) != 1 || ents[0].Index != 2 {
+		t.Fatalf("expected the oversized entry to be returned on its own, got %v", ents)
+	}
+}
+
+func TestNextEntsExactBoundary(t *testing.T) {
+	e1 := pb.Entry{Index: 2, Term: 1, Data: []byte("x")}
+	e2 := pb.Entry{Index: 3, Term: 1, Data: []byte("y")}
+	e3 := pb.Entry{Index: 4, Term: 1, Data: []byte("zzzzzzzz")}
+	l := newTestRaftLogFromSnapshot(1, &e1, &e2, &e3)
+	l.committed = 4
+	l.applied = 1
+	l.maxNextEntsSize = uint64(e1.Size() + e2.Size())
+
+	ents := l.nextEnts()
+	if len(ents) != 2 || ents[0].Index != 2 || ents[1].Index != 3 {
+		t.Fatalf("expected exactly the entries fitting the size boundary, got %v", ents)
+	}
+}
+
+func TestNextEntsWithPendingSnapshotInteraction(t *testing.T) {
+	l := &RaftLog{maxNextEntsSize: noLimit}
+	// a freshly restored snapshot at index 5, followed by two more entries
+	// the leader has since replicated on top of it (a realistic
+	// mid-InstallSnapshot-persistence state: the snapshot is still pending
+	// while newer entries have already arrived).
+	l.restore(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 5, Term: 2}})
+	l.AppendEntries(&pb.Entry{Index: 6, Term: 2}, &pb.Entry{Index: 7, Term: 2})
+	l.applied = 5
+	l.committed = 7
+
+	if !l.hasPendingSnapshot() {
+		t.Fatalf("expected the restored snapshot to still be pending")
+	}
+	ents := l.nextEnts()
+	if len(ents) != 2 || ents[0].Index != 6 || ents[1].Index != 7 {
+		t.Fatalf("expected both post-snapshot entries to be returned, got %v", ents)
+	}
+}
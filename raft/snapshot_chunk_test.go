@@ -0,0 +1,145 @@
+package raft
+
+import (
+	"bytes"
+	"testing"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+func TestSplitSnapshotData(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 25)
+	chunks := splitSnapshotData(data, 10)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	if len(chunks[0]) != 10 || len(chunks[1]) != 10 || len(chunks[2]) != 5 {
+		t.Fatalf("unexpected chunk sizes: %v", []int{len(chunks[0]), len(chunks[1]), len(chunks[2])})
+	}
+	var rebuilt []byte
+	for _, c := range chunks {
+		rebuilt = append(rebuilt, c...)
+	}
+	if !bytes.Equal(rebuilt, data) {
+		t.Fatalf("chunks did not reassemble to the original data")
+	}
+}
+
+func TestSplitSnapshotDataEmpty(t *testing.T) {
+	chunks := splitSnapshotData(nil, 10)
+	if len(chunks) != 1 || len(chunks[0]) != 0 {
+		t.Fatalf("expected a single empty chunk, got %v", chunks)
+	}
+}
+
+func TestSnapshotAssemblerAssemblesOnDone(t *testing.T) {
+	var a snapshotAssembler
+	if snap, ok := a.addChunk(5, 2, 0, []byte("ab"), false); ok || snap != nil {
+		t.Fatalf("assembler should not produce a snapshot before done=true")
+	}
+	snap, ok := a.addChunk(5, 2, 2, []byte("cd"), true)
+	if !ok || snap == nil {
+		t.Fatalf("expected a snapshot once the done chunk arrives")
+	}
+	if !bytes.Equal(snap.Data, []byte("abcd")) {
+		t.Fatalf("expected reassembled data %q, got %q", "abcd", snap.Data)
+	}
+	if snap.Metadata.Index != 5 || snap.Metadata.Term != 2 {
+		t.Fatalf("unexpected snapshot metadata: %+v", snap.Metadata)
+	}
+}
+
+func TestSnapshotAssemblerDiscardsOnIndexTermChange(t *testing.T) {
+	var a snapshotAssembler
+	a.addChunk(5, 2, 0, []byte("stale"), false)
+	// a new transfer for a different (index, term) starts: the leader
+	// must have restarted the InstallSnapshot, so the old buffer is gone.
+	snap, ok := a.addChunk(6, 3, 0, []byte("fresh"), true)
+	if !ok || snap == nil {
+		t.Fatalf("expected the new transfer to assemble on its own done chunk")
+	}
+	if !bytes.Equal(snap.Data, []byte("fresh")) {
+		t.Fatalf("expected only the new transfer's data, got %q", snap.Data)
+	}
+}
+
+func TestSnapshotAssemblerDiscardsOnOffsetMismatch(t *testing.T) {
+	var a snapshotAssembler
+	a.addChunk(5, 2, 0, []byte("ab"), false)
+	// a chunk that doesn't line up with what's buffered so far (e.g. a
+	// duplicate or a gap) must drop the transfer instead of assembling
+	// garbage.
+	if snap, ok := a.addChunk(5, 2, 4, []byte("ef"), true); ok || snap != nil {
+		t.Fatalf("expected an offset mismatch to be rejected, got %v, %v", snap, ok)
+	}
+	// the leader retries from the start and the transfer proceeds normally.
+	snap, ok := a.addChunk(5, 2, 0, []byte("ab"), true)
+	if !ok || snap == nil {
+		t.Fatalf("expected the retried transfer to assemble")
+	}
+}
+
+func TestSnapshotSenderYieldsChunksThenStops(t *testing.T) {
+	snap := pb.Snapshot{
+		Data:     bytes.Repeat([]byte("x"), 25),
+		Metadata: &pb.SnapshotMetadata{Index: 9, Term: 4},
+	}
+	s := newSnapshotSender(snap, 10)
+
+	offset, data, done, ok := s.nextChunk()
+	if !ok || done || offset != 0 || len(data) != 10 {
+		t.Fatalf("unexpected first chunk: offset=%d len=%d done=%v ok=%v", offset, len(data), done, ok)
+	}
+	offset, data, done, ok = s.nextChunk()
+	if !ok || done || offset != 10 || len(data) != 10 {
+		t.Fatalf("unexpected second chunk: offset=%d len=%d done=%v ok=%v", offset, len(data), done, ok)
+	}
+	offset, data, done, ok = s.nextChunk()
+	if !ok || !done || offset != 20 || len(data) != 5 {
+		t.Fatalf("unexpected last chunk: offset=%d len=%d done=%v ok=%v", offset, len(data), done, ok)
+	}
+	if _, _, _, ok = s.nextChunk(); ok {
+		t.Fatalf("expected no more chunks once the last one is done")
+	}
+}
+
+func TestSnapshotSenderRoundTripsThroughAssembler(t *testing.T) {
+	snap := pb.Snapshot{
+		Data:     bytes.Repeat([]byte("y"), 17),
+		Metadata: &pb.SnapshotMetadata{Index: 3, Term: 1},
+	}
+	sender := newSnapshotSender(snap, 6)
+	var assembler snapshotAssembler
+	var got *pb.Snapshot
+	for {
+		offset, data, done, ok := sender.nextChunk()
+		if !ok {
+			t.Fatalf("sender ran out of chunks before the assembler saw done=true")
+		}
+		if got, ok = assembler.addChunk(snap.Metadata.Index, snap.Metadata.Term, offset, data, done); ok {
+			break
+		}
+	}
+	if !bytes.Equal(got.Data, snap.Data) {
+		t.Fatalf("expected reassembled data %q, got %q", snap.Data, got.Data)
+	}
+}
+
+func TestHandleSnapshotChunkInstallsOnceDone(t *testing.T) {
+	l := &RaftLog{}
+	if installed := l.handleSnapshotChunk(7, 3, 0, []byte("ab"), false); installed {
+		t.Fatalf("snapshot should not be installed before done=true")
+	}
+	if l.hasPendingSnapshot() {
+		t.Fatalf("a half-received snapshot must not be visible as pending")
+	}
+	if installed := l.handleSnapshotChunk(7, 3, 2, []byte("cd"), true); !installed {
+		t.Fatalf("expected the snapshot to be installed once assembly finishes")
+	}
+	if !l.hasPendingSnapshot() {
+		t.Fatalf("expected a pending snapshot after installation")
+	}
+	if l.committed != 7 {
+		t.Fatalf("expected committed to advance to the snapshot index, got %d", l.committed)
+	}
+}
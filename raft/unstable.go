@@ -0,0 +1,122 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+
+// unstable holds the part of the raft log that has not yet been written to
+// Storage, plus the pending snapshot RaftLog is still waiting to apply.
+// unstable.entries[i] has raft log position i+unstable.offset.
+//
+// Note that unstable.offset may be greater than the storage's last index;
+// this happens right after restore(), before any new entry has been
+// appended.
+type unstable struct {
+	// the incoming unstable snapshot, if any.
+	snapshot *pb.Snapshot
+	// all entries that have not yet been written to storage.
+	entries []pb.Entry
+	offset  uint64
+}
+
+// maybeFirstIndex returns the index of the first possible entry, which is
+// the pending snapshot's index plus one, if a snapshot is present.
+func (u *unstable) maybeFirstIndex() (uint64, bool) {
+	if u.snapshot != nil {
+		return u.snapshot.Metadata.Index + 1, true
+	}
+	return 0, false
+}
+
+// maybeLastIndex returns the last index if the unstable buffer is not
+// empty, i.e. it holds entries or a pending snapshot.
+func (u *unstable) maybeLastIndex() (uint64, bool) {
+	if l := len(u.entries); l != 0 {
+		return u.offset + uint64(l) - 1, true
+	}
+	if u.snapshot != nil {
+		return u.snapshot.Metadata.Index, true
+	}
+	return 0, false
+}
+
+// maybeTerm returns the term of the entry at index i, if it is present in
+// the unstable buffer (either as an entry or as the pending snapshot).
+func (u *unstable) maybeTerm(i uint64) (uint64, bool) {
+	if i < u.offset {
+		if u.snapshot != nil && u.snapshot.Metadata.Index == i {
+			return u.snapshot.Metadata.Term, true
+		}
+		return 0, false
+	}
+	last, ok := u.maybeLastIndex()
+	if !ok || i > last {
+		return 0, false
+	}
+	return u.entries[i-u.offset].Term, true
+}
+
+// stableTo marks the entries up to and including index i, term t as
+// persisted to storage, releasing them from the unstable buffer.
+func (u *unstable) stableTo(i, t uint64) {
+	gt, ok := u.maybeTerm(i)
+	if !ok {
+		return
+	}
+	if gt == t && i >= u.offset {
+		u.entries = u.entries[i+1-u.offset:]
+		u.offset = i + 1
+	}
+}
+
+// stableSnapTo marks the pending snapshot at index i as persisted.
+func (u *unstable) stableSnapTo(i uint64) {
+	if u.snapshot != nil && u.snapshot.Metadata.Index == i {
+		u.snapshot = nil
+	}
+}
+
+// restore replaces the unstable entries and pending snapshot with the
+// given snapshot, e.g. after the application installs it.
+func (u *unstable) restore(s *pb.Snapshot) {
+	u.offset = s.Metadata.Index + 1
+	u.entries = nil
+	u.snapshot = s
+}
+
+// truncateAndAppend appends ents to the unstable buffer, first truncating
+// any unstable entries that conflict with the incoming ones.
+func (u *unstable) truncateAndAppend(ents []pb.Entry) {
+	fromIndex := ents[0].Index
+	switch {
+	case fromIndex == u.offset+uint64(len(u.entries)):
+		// directly append
+		u.entries = append(u.entries, ents...)
+	case fromIndex <= u.offset:
+		// ents replaces the unstable buffer wholesale
+		u.offset = fromIndex
+		u.entries = ents
+	default:
+		// truncate to fromIndex and append the new entries
+		u.entries = append([]pb.Entry{}, u.slice(u.offset, fromIndex)...)
+		u.entries = append(u.entries, ents...)
+	}
+}
+
+// slice returns entries in the range [lo, hi), both of which must lie
+// within the unstable buffer.
+func (u *unstable) slice(lo, hi uint64) []pb.Entry {
+	return u.entries[lo-u.offset : hi-u.offset]
+}